@@ -0,0 +1,323 @@
+package test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// amiFingerprintTag is the EC2 tag we stamp on every AMI this test suite builds. Its value is a sha256 of everything
+// that can affect the resulting image, so two runs with identical inputs produce identical tag values and we can
+// use DescribeImages to find a reusable AMI instead of re-running Packer.
+const amiFingerprintTag = "couchbase-ami-fingerprint"
+
+// amiCreatedAtTag records when an AMI was built so GcOldAmis knows which ones are safe to clean up.
+const amiCreatedAtTag = "created-at"
+
+// skipAmiCacheEnvVar, when set to "true", forces buildCouchbaseWithPacker to rebuild the AMI even if a cache hit
+// would otherwise be available. Handy when iterating on the Packer template itself.
+const skipAmiCacheEnvVar = "SKIP_AMI_CACHE"
+
+// AmiCache looks up and tags Packer-built AMIs by a content fingerprint of their inputs, so that repeated test runs
+// against an unchanged module tree can skip the Packer build entirely. This is the same idea as Go's build cache:
+// hash the inputs, and if we've already produced output for that hash, reuse it.
+type AmiCache struct {
+	ec2Client *ec2.EC2
+	region    string
+}
+
+// usedAmiCacheRegions records every region an AmiCache has been created for during this test run, so that
+// GcAllCachedAmis knows which regions to sweep without every test having to report its region separately.
+var (
+	usedAmiCacheRegionsMu sync.Mutex
+	usedAmiCacheRegions   = map[string]bool{}
+)
+
+// NewAmiCache creates an AmiCache backed by the EC2 API in the given region.
+func NewAmiCache(region string) (*AmiCache, error) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, err
+	}
+
+	usedAmiCacheRegionsMu.Lock()
+	usedAmiCacheRegions[region] = true
+	usedAmiCacheRegionsMu.Unlock()
+
+	return &AmiCache{ec2Client: ec2.New(sess), region: region}, nil
+}
+
+// computeAmiFingerprint hashes the Packer template contents, the resolved builder name, edition, base AMI name,
+// region, and the contents of every file under moduleSourcePath that Packer could reference. The result is a stable
+// sha256 hex digest that changes whenever any of those inputs change.
+func computeAmiFingerprint(templatePath string, builderName string, edition string, baseAmiName string, region string, moduleSourcePath string) (string, error) {
+	hasher := sha256.New()
+
+	templateContents, err := ioutil.ReadFile(templatePath)
+	if err != nil {
+		return "", err
+	}
+	hasher.Write(templateContents)
+
+	fmt.Fprintf(hasher, "builder=%s\nedition=%s\nbaseAmiName=%s\nregion=%s\n", builderName, edition, baseAmiName, region)
+
+	fileHashes, err := hashModuleFiles(moduleSourcePath)
+	if err != nil {
+		return "", err
+	}
+	for _, fileHash := range fileHashes {
+		fmt.Fprintln(hasher, fileHash)
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// hashModuleFiles returns a sorted list of "relativePath:sha256" entries for every file under root, skipping the
+// same dotfiles/dot-dirs stageModuleSource skips, so the fingerprint is independent of walk order.
+func hashModuleFiles(root string) ([]string, error) {
+	var entries []string
+
+	// Resolve symlinks before walking, the same way stageModuleSource does: filepath.Walk lstats its root and
+	// won't descend into it if the root itself is a symlink (e.g. a GOPATH or CI checkout reached through a
+	// symlinked directory), which would otherwise make this return zero file-hash entries.
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+
+	err = filepath.Walk(resolvedRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(resolvedRoot, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+
+		name := info.Name()
+		if strings.HasPrefix(name, ".") && dotPathsToSkip[name] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		hasher := sha256.New()
+		if _, err := io.Copy(hasher, file); err != nil {
+			return err
+		}
+
+		entries = append(entries, fmt.Sprintf("%s:%s", relPath, hex.EncodeToString(hasher.Sum(nil))))
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(entries)
+	return entries, nil
+}
+
+// FindAmiByFingerprint returns the AMI ID of an existing, self-owned AMI tagged with the given fingerprint, or ""
+// if no such AMI exists.
+func (cache *AmiCache) FindAmiByFingerprint(fingerprint string) (string, error) {
+	output, err := cache.ec2Client.DescribeImages(&ec2.DescribeImagesInput{
+		Owners: []*string{aws.String("self")},
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String(fmt.Sprintf("tag:%s", amiFingerprintTag)),
+				Values: []*string{aws.String(fingerprint)},
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(output.Images) == 0 {
+		return "", nil
+	}
+
+	return aws.StringValue(output.Images[0].ImageId), nil
+}
+
+// TagAmiWithFingerprint stamps the given AMI with its content fingerprint and a created-at timestamp so future runs
+// can find it via FindAmiByFingerprint and GcOldAmis can eventually clean it up.
+func (cache *AmiCache) TagAmiWithFingerprint(amiId string, fingerprint string, createdAt time.Time) error {
+	_, err := cache.ec2Client.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{aws.String(amiId)},
+		Tags: []*ec2.Tag{
+			{Key: aws.String(amiFingerprintTag), Value: aws.String(fingerprint)},
+			{Key: aws.String(amiCreatedAtTag), Value: aws.String(strconv.FormatInt(createdAt.Unix(), 10))},
+		},
+	})
+
+	return err
+}
+
+// GcOldAmis deregisters every self-owned, fingerprint-tagged AMI whose created-at tag is older than olderThan. It's
+// meant to be called from test teardown so the cache doesn't accumulate AMIs forever.
+func (cache *AmiCache) GcOldAmis(olderThan time.Duration) error {
+	output, err := cache.ec2Client.DescribeImages(&ec2.DescribeImagesInput{
+		Owners: []*string{aws.String("self")},
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String(amiFingerprintTag)},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+
+	for _, image := range output.Images {
+		createdAt, ok := createdAtFromTags(image.Tags)
+		if !ok || createdAt.After(cutoff) {
+			continue
+		}
+
+		if _, err := cache.ec2Client.DeregisterImage(&ec2.DeregisterImageInput{
+			ImageId: image.ImageId,
+		}); err != nil {
+			return err
+		}
+
+		for _, blockDevice := range image.BlockDeviceMappings {
+			if blockDevice.Ebs == nil || blockDevice.Ebs.SnapshotId == nil {
+				continue
+			}
+
+			if _, err := cache.ec2Client.DeleteSnapshot(&ec2.DeleteSnapshotInput{
+				SnapshotId: blockDevice.Ebs.SnapshotId,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// amiGcMaxAge is how old a cached AMI needs to be, per its created-at tag, before GcAllCachedAmis will deregister
+// it.
+const amiGcMaxAge = 14 * 24 * time.Hour
+
+// GcAllCachedAmis runs GcOldAmis against every region an AmiCache was created in during this test run. It's meant
+// to be called once, from TestMain, after m.Run() returns, so AMIs produced by the content-addressed cache don't
+// accumulate in the account forever.
+func GcAllCachedAmis() {
+	usedAmiCacheRegionsMu.Lock()
+	regions := make([]string, 0, len(usedAmiCacheRegions))
+	for region := range usedAmiCacheRegions {
+		regions = append(regions, region)
+	}
+	usedAmiCacheRegionsMu.Unlock()
+
+	for _, region := range regions {
+		cache, err := NewAmiCache(region)
+		if err != nil {
+			fmt.Printf("Failed to create AmiCache for %s during GC: %s\n", region, err.Error())
+			continue
+		}
+
+		if err := cache.GcOldAmis(amiGcMaxAge); err != nil {
+			fmt.Printf("Failed to GC old AMIs in %s: %s\n", region, err.Error())
+		}
+	}
+}
+
+// createdAtFromTags extracts the created-at tag from an AMI's tag set, returning ok=false if it's missing or
+// unparsable.
+func createdAtFromTags(tags []*ec2.Tag) (time.Time, bool) {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) != amiCreatedAtTag {
+			continue
+		}
+
+		unixSeconds, err := strconv.ParseInt(aws.StringValue(tag.Value), 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+
+		return time.Unix(unixSeconds, 0), true
+	}
+
+	return time.Time{}, false
+}
+
+// skipAmiCache returns true if the SKIP_AMI_CACHE env var is set to force a fresh Packer build.
+func skipAmiCache() bool {
+	return os.Getenv(skipAmiCacheEnvVar) == "true"
+}
+
+// buildCouchbaseWithPackerCached wraps buildCouchbaseWithPacker with the fingerprint cache described above: it
+// returns a matching AMI ID without invoking Packer if one already exists, and tags newly-built AMIs so the next
+// run can find them.
+func buildCouchbaseWithPackerCached(logger *log.Logger, builderName string, baseAmiName string, awsRegion string, folderPath string, moduleRootPath string, edition string) (string, error) {
+	cache, err := NewAmiCache(awsRegion)
+	if err != nil {
+		return "", err
+	}
+
+	templatePath, _, err := resolveTemplatePath(folderPath)
+	if err != nil {
+		return "", err
+	}
+
+	fingerprint, err := computeAmiFingerprint(templatePath, builderName, edition, baseAmiName, awsRegion, moduleRootPath)
+	if err != nil {
+		return "", err
+	}
+
+	if !skipAmiCache() {
+		if amiId, err := cache.FindAmiByFingerprint(fingerprint); err != nil {
+			return "", err
+		} else if amiId != "" {
+			logger.Printf("Found cached AMI %s for fingerprint %s, skipping Packer build", amiId, fingerprint)
+			return amiId, nil
+		}
+	}
+
+	amiId, err := buildCouchbaseWithPacker(logger, builderName, baseAmiName, awsRegion, folderPath, moduleRootPath, edition)
+	if err != nil {
+		return "", err
+	}
+
+	if err := cache.TagAmiWithFingerprint(amiId, fingerprint, time.Now()); err != nil {
+		return "", err
+	}
+
+	return amiId, nil
+}
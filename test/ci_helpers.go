@@ -0,0 +1,118 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest"
+)
+
+// IsCI returns true if we appear to be running in a CI environment, based on the env vars the major CI providers
+// set on every build.
+func IsCI() bool {
+	return os.Getenv("CI") != "" || os.Getenv("CIRCLECI") != "" || os.Getenv("GITHUB_ACTIONS") != ""
+}
+
+// IsLocal returns true if we do NOT appear to be running in CI -- i.e., a developer is running the tests on their
+// own machine.
+func IsLocal() bool {
+	return !IsCI()
+}
+
+// SkipUnlessCI skips the calling test when the caller passed -short, and otherwise unless we're running in CI, which
+// lets the heavyweight, AMI-building acceptance tests be skipped by default on a developer's machine while still
+// running in the full CI matrix.
+func SkipUnlessCI(t *testing.T, reason string) {
+	t.Helper()
+
+	if testing.Short() {
+		t.Skip(reason)
+	}
+
+	if IsLocal() {
+		t.Skip(reason)
+	}
+}
+
+// flakyTestRecord tracks a test that failed at least once before eventually passing, so we can report it in the
+// end-of-suite flaky test summary.
+type flakyTestRecord struct {
+	name           string
+	attemptsNeeded int
+}
+
+var (
+	flakyTestsMu sync.Mutex
+	flakyTests   []flakyTestRecord
+)
+
+func recordFlakyTest(name string, attemptsNeeded int) {
+	flakyTestsMu.Lock()
+	defer flakyTestsMu.Unlock()
+
+	flakyTests = append(flakyTests, flakyTestRecord{name: name, attemptsNeeded: attemptsNeeded})
+}
+
+// PrintFlakyTestSummary prints a JUnit-style summary of every test that only passed after one or more retries via
+// RunWithRetry. Intended to be called once, from TestMain, after m.Run() returns, so genuinely flaky tests can be
+// tracked over time instead of just disappearing into a green build.
+func PrintFlakyTestSummary() {
+	flakyTestsMu.Lock()
+	defer flakyTestsMu.Unlock()
+
+	if len(flakyTests) == 0 {
+		return
+	}
+
+	fmt.Println("\n===== Flaky test summary (passed only after retry) =====")
+	for _, record := range flakyTests {
+		fmt.Printf("  %s: passed on attempt %d\n", record.name, record.attemptsNeeded)
+	}
+	fmt.Println("==========================================================")
+}
+
+// RunWithRetry runs fn as a sub-test of t named name, up to attempts times in total, with exponential backoff between
+// failed attempts. RunWithRetry creates a fresh RandomResourceCollection for each attempt and passes it to fn, so that if an
+// attempt fails, it can tear those resources down before the next attempt -- a failed attempt shouldn't leak its
+// AWS resources into the retry. The collection is created before fn runs (rather than returned by fn) so it's
+// available for teardown even if fn calls t.Fatalf and never returns normally.
+func RunWithRetry(t *testing.T, name string, attempts int, backoff time.Duration, fn func(t *testing.T, resourceCollection *terratest.RandomResourceCollection)) {
+	t.Helper()
+
+	t.Run(name, func(t *testing.T) {
+		currentBackoff := backoff
+
+		for attempt := 1; attempt <= attempts; attempt++ {
+			resourceCollection := createBaseRandomResourceCollection(t)
+
+			passed := t.Run(fmt.Sprintf("attempt-%d", attempt), func(t *testing.T) {
+				fn(t, resourceCollection)
+			})
+
+			// Tear down this attempt's resources whether it passed or failed -- a passing attempt still needs
+			// its RandomResourceCollection released, or every green run leaks it permanently.
+			if err := terratest.DestroyRandomResourceCollection(resourceCollection); err != nil {
+				t.Logf("Failed to tear down resources after attempt %d for %s: %s", attempt, name, err.Error())
+			}
+
+			if passed {
+				if attempt > 1 {
+					recordFlakyTest(name, attempt)
+				}
+				return
+			}
+
+			if attempt == attempts {
+				t.Fatalf("%s did not pass after %d attempts", name, attempts)
+				return
+			}
+
+			t.Logf("%s failed on attempt %d/%d; retrying in %s", name, attempt, attempts, currentBackoff)
+			time.Sleep(currentBackoff)
+			currentBackoff *= 2
+		}
+	})
+}
@@ -0,0 +1,46 @@
+package test
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest"
+)
+
+// TestCouchbaseWindows deploys the Windows example with a Packer "windows" builder, then verifies the resulting
+// node over WinRM instead of the HTTP checks the Linux examples use. AMI builds and AWS eventual consistency make
+// this acceptance test prone to transient failures, so it runs through RunWithRetry.
+func TestCouchbaseWindows(t *testing.T) {
+	t.Parallel()
+	SkipUnlessCI(t, "Building and deploying a Windows AMI is slow; skipping outside of CI or with -short")
+
+	RunWithRetry(t, "TestCouchbaseWindows", 3, 30*time.Second, func(t *testing.T, resourceCollection *terratest.RandomResourceCollection) {
+		logger := log.New(os.Stdout, "TestCouchbaseWindows: ", log.LstdFlags)
+
+		amiId, err := buildCouchbaseWithPackerCached(logger, "windows", "Windows_Server-2019-English-Full-Base", resourceCollection.AwsRegion, "../examples/couchbase-ami", "..", "enterprise")
+		if err != nil {
+			t.Fatalf("Failed to build Windows Couchbase AMI: %s", err.Error())
+		}
+
+		terratestOptions := createBaseTerratestOptions(t, "TestCouchbaseWindows", "../examples/couchbase-cluster-windows", resourceCollection)
+		terratestOptions.Vars = map[string]interface{}{
+			"ami_id":       amiId,
+			"cluster_name": fmt.Sprintf("couchbase-windows-%s", resourceCollection.UniqueId),
+		}
+
+		defer terratest.Destroy(terratestOptions)
+		deploy(t, terratestOptions)
+
+		output, err := terratest.Output(terratestOptions, "couchbase_node_public_ip")
+		if err != nil {
+			t.Fatalf("Failed to get couchbase_node_public_ip output: %s", err.Error())
+		}
+
+		if err := verifyCouchbaseWinRM(logger, output, usernameForTest, passwordForTest); err != nil {
+			t.Fatalf("Failed to verify Couchbase over WinRM: %s", err.Error())
+		}
+	})
+}
@@ -0,0 +1,17 @@
+package test
+
+import (
+	"os"
+	"testing"
+)
+
+// TestMain lets us print a flaky test summary and garbage-collect old cached AMIs after the whole suite runs,
+// regardless of which individual tests used RunWithRetry or the AMI cache.
+func TestMain(m *testing.M) {
+	exitCode := m.Run()
+
+	PrintFlakyTestSummary()
+	GcAllCachedAmis()
+
+	os.Exit(exitCode)
+}
@@ -12,6 +12,9 @@ import (
 	"io/ioutil"
 	"strings"
 	"os"
+	"io"
+	"path/filepath"
+	"syscall"
 )
 
 // The username and password we use in all the examples, mocks, and tests
@@ -46,28 +49,203 @@ func createBaseTerratestOptions(t *testing.T, testName string, folder string, re
 	return terratestOptions
 }
 
-func buildCouchbaseWithPacker(logger *log.Logger, builderName string, baseAmiName string, awsRegion string, folderPath string, edition string) (string, error) {
-	templatePath := fmt.Sprintf("%s/couchbase.json", folderPath)
+// dotPathsToSkip is the set of top-level-style directory/file names we never want to copy into the staged module
+// source, either because they're VCS/tool state (.git, .terraform) or CI-specific config (.circleci) that has no
+// bearing on the actual Packer build.
+var dotPathsToSkip = map[string]bool{
+	".git":       true,
+	".terraform": true,
+	".circleci":  true,
+}
+
+// stageModuleSource copies the entire module tree rooted at moduleSourcePath into a stable temporary directory and
+// returns the path to that copy. The Packer file provisioner we use copies this whole module from root_folder_path,
+// which the templates default to a relative path (../../), and a relative path only finds the module if the checkout
+// directory is laid out exactly as expected. That assumption breaks on CI systems that check the code out under a
+// different directory name (or behind a symlink), so instead we stage a fresh copy in a new temporary directory and
+// point Packer's root_folder_path at that instead.
+func stageModuleSource(logger *log.Logger, moduleSourcePath string) (string, error) {
+	resolvedSource, err := filepath.EvalSymlinks(moduleSourcePath)
+	if err != nil {
+		return "", err
+	}
+
+	destPath, err := ioutil.TempDir("", "terraform-aws-couchbase-")
+	if err != nil {
+		return "", err
+	}
+
+	resolvedDest, err := filepath.EvalSymlinks(destPath)
+	if err != nil {
+		return "", err
+	}
+
+	logger.Printf("Staging module source from %s to %s", resolvedSource, resolvedDest)
+
+	err = filepath.Walk(resolvedSource, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(resolvedSource, path)
+		if err != nil {
+			return err
+		}
+
+		if relPath == "." {
+			return nil
+		}
+
+		name := info.Name()
+		if strings.HasPrefix(name, ".") && dotPathsToSkip[name] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Never recurse into the destination directory, in case it happens to be nested inside the source tree.
+		if path == resolvedDest || strings.HasPrefix(path, resolvedDest+string(os.PathSeparator)) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		destFilePath := filepath.Join(resolvedDest, relPath)
+
+		if info.IsDir() {
+			return os.MkdirAll(destFilePath, info.Mode())
+		}
+
+		if sameFile(path, destFilePath) {
+			return nil
+		}
+
+		return copyFile(path, destFilePath, info.Mode())
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return resolvedDest, nil
+}
+
+// sameFile returns true if src and dest already refer to the same file on disk (same device and inode), so that
+// stageModuleSource doesn't try to overwrite a file with itself.
+func sameFile(src string, dest string) bool {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return false
+	}
+
+	destInfo, err := os.Stat(dest)
+	if err != nil {
+		return false
+	}
+
+	srcStat, ok := srcInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+
+	destStat, ok := destInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+
+	return srcStat.Dev == destStat.Dev && srcStat.Ino == destStat.Ino
+}
+
+// copyFile copies a single file from src to dest, preserving the given file mode.
+func copyFile(src string, dest string, mode os.FileMode) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	destFile, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+
+	_, err = io.Copy(destFile, srcFile)
+	return err
+}
+
+// jsonTemplateName and hcl2TemplateName are the two Packer template filenames buildCouchbaseWithPacker looks for,
+// in preference order: HCL2 first since JSON is HashiCorp's deprecated legacy format.
+const jsonTemplateName = "couchbase.json"
+const hcl2TemplateName = "couchbase.pkr.hcl"
+
+// resolveTemplatePath looks in folderPath for a Packer template, preferring the HCL2 template over the legacy JSON
+// one. It returns the path to whichever it found and whether that template is HCL2.
+func resolveTemplatePath(folderPath string) (string, bool, error) {
+	hcl2Path := fmt.Sprintf("%s/%s", folderPath, hcl2TemplateName)
+	if _, err := os.Stat(hcl2Path); err == nil {
+		return hcl2Path, true, nil
+	}
+
+	jsonPath := fmt.Sprintf("%s/%s", folderPath, jsonTemplateName)
+	if _, err := os.Stat(jsonPath); err == nil {
+		return jsonPath, false, nil
+	}
+
+	return "", false, fmt.Errorf("could not find a Packer template (%s or %s) in %s", hcl2TemplateName, jsonTemplateName, folderPath)
+}
+
+// hcl2SourceName converts a legacy JSON builder name (e.g. "ubuntu") into the "source.<type>.<name>" reference
+// HCL2's Only option expects, leaving an already-qualified name (e.g. "source.amazon-ebs.ubuntu") untouched.
+func hcl2SourceName(builderName string) string {
+	if strings.HasPrefix(builderName, "source.") {
+		return builderName
+	}
+
+	return fmt.Sprintf("source.amazon-ebs.%s", builderName)
+}
+
+// buildCouchbaseWithPacker runs Packer against the template in folderPath. moduleRootPath is the root of this
+// module (the directory containing modules/, not the example's own folder) -- it's what gets staged and handed to
+// Packer's file provisioner as root_folder_path, since the templates reference paths like
+// modules/install-couchbase-server relative to that root, not relative to folderPath.
+func buildCouchbaseWithPacker(logger *log.Logger, builderName string, baseAmiName string, awsRegion string, folderPath string, moduleRootPath string, edition string) (string, error) {
+	templatePath, isHCL2, err := resolveTemplatePath(folderPath)
+	if err != nil {
+		return "", err
+	}
+
+	stagedFolderPath, err := stageModuleSource(logger, moduleRootPath)
+	if err != nil {
+		return "", err
+	}
+
+	vars := map[string]string{
+		"aws_region": awsRegion,
+		"base_ami_name": baseAmiName,
+		"edition": edition,
+		// The trailing slash makes Packer's file provisioner upload the directory's contents into its destination,
+		// where the templates' install steps expect modules/, rather than nesting the staged directory inside it.
+		"root_folder_path": stagedFolderPath + string(os.PathSeparator),
+	}
+
+	only := builderName
+	if isHCL2 {
+		only = hcl2SourceName(builderName)
+	}
+
+	// HCL2 templates declare typed variable blocks, which Packer also accepts as -var flags -- the same
+	// mechanism options.Vars below uses for the legacy JSON templates. We deliberately don't also set
+	// PACKER_VAR_<name> env vars here: this function can be called concurrently by parallel tests (e.g.
+	// TestCouchbaseWindows uses t.Parallel()), and mutating the process environment would let one build's vars
+	// clobber another's mid-build.
 
 	options := packer.PackerOptions{
 		Template: templatePath,
-		Only: builderName,
-		Vars: map[string]string{
-			"aws_region": awsRegion,
-			"base_ami_name": baseAmiName,
-			"edition": edition,
-		},
-	}
-
-	// The Packer file provisioner we use tries to copy this entire Couchbase module using a relative path like
-	// ../../../terraform-aws-couchbase. This works fine in a normal checkout, but with CircleCi, (a) the code is
-	// checked out into a folder called "project" and not "terraform-aws-couchbase" and (b) to support GOPATH, we
-	// create a symlink to the original project and run the tests from that symlinked folder. One or both of these
-	// issues leads to very strange issues that sometimes cause the Packer build to fail:
-	// https://github.com/hashicorp/packer/issues/6103
-	if os.Getenv("CIRCLECI") != "" {
-		logger.Printf("Overriding root folder path for Packer build to /home/circleci/project/")
-		options.Vars["root_folder_path"] = "/home/circleci/project/"
+		Only: only,
+		Vars: vars,
 	}
 
 	return packer.BuildAmi(options, logger)
@@ -0,0 +1,108 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/masterzen/winrm"
+)
+
+// winrmPort is the HTTPS listener Couchbase's Windows AMIs expose WinRM on.
+const winrmPort = 5986
+
+// waitForWinRM polls host:5986/tcp until it accepts a connection or timeout elapses, retrying every retryInterval.
+// WinRM isn't up the instant the instance reports "running", so callers need to wait for it the same way we'd wait
+// for an HTTP endpoint on the Linux side.
+func waitForWinRM(logger *log.Logger, host string, timeout time.Duration, retryInterval time.Duration) error {
+	address := fmt.Sprintf("%s:%d", host, winrmPort)
+	deadline := time.Now().Add(timeout)
+
+	var lastErr error
+	for time.Now().Before(deadline) {
+		conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+
+		lastErr = err
+		logger.Printf("WinRM listener at %s not ready yet: %s", address, err.Error())
+		time.Sleep(retryInterval)
+	}
+
+	return fmt.Errorf("timed out after %s waiting for WinRM listener at %s: %s", timeout, address, lastErr)
+}
+
+// runWinRMCommand executes command in a fresh WinRM shell and returns its stdout, stderr, and exit code. Stdout and
+// stderr are drained on separate goroutines, joined via a sync.WaitGroup before we read the exit code -- a naive
+// io.Copy against the command's streams on the calling goroutine races with command completion and produces flaky,
+// truncated output.
+func runWinRMCommand(client *winrm.Client, command string) (string, string, int, error) {
+	shell, err := client.CreateShell()
+	if err != nil {
+		return "", "", -1, err
+	}
+	defer shell.Close()
+
+	cmd, err := shell.Execute(command)
+	if err != nil {
+		return "", "", -1, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(2)
+
+	go func() {
+		defer waitGroup.Done()
+		io.Copy(&stdout, cmd.Stdout)
+	}()
+	go func() {
+		defer waitGroup.Done()
+		io.Copy(&stderr, cmd.Stderr)
+	}()
+
+	cmd.Wait()
+	waitGroup.Wait()
+
+	return stdout.String(), stderr.String(), cmd.ExitCode(), nil
+}
+
+// verifyCouchbaseWinRM waits for the Windows node's WinRM listener to come up, authenticates with username and
+// password, and runs a couchbase-cli cluster-init smoke test to confirm the AMI deployed correctly.
+func verifyCouchbaseWinRM(logger *log.Logger, host string, username string, password string) error {
+	if err := waitForWinRM(logger, host, 5*time.Minute, 15*time.Second); err != nil {
+		return err
+	}
+
+	winrmEndpoint := winrm.NewEndpoint(host, winrmPort, true, true, nil, nil, nil, 0)
+	client, err := winrm.NewClient(winrmEndpoint, username, password)
+	if err != nil {
+		return err
+	}
+
+	clusterInitCommand := fmt.Sprintf(
+		`couchbase-cli cluster-init -c localhost --cluster-username %s --cluster-password %s --cluster-ramsize 512`,
+		username,
+		password,
+	)
+
+	stdout, stderr, exitCode, err := runWinRMCommand(client, clusterInitCommand)
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("couchbase-cli cluster-init stdout: %s", stdout)
+	logger.Printf("couchbase-cli cluster-init stderr: %s", stderr)
+
+	if exitCode != 0 {
+		return fmt.Errorf("couchbase-cli cluster-init exited with code %d: %s", exitCode, stderr)
+	}
+
+	return nil
+}